@@ -0,0 +1,202 @@
+/*
+Copyright 2019 The Crossplane Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+
+	"github.com/crossplaneio/crossplane/apis/stacks/v1alpha1"
+)
+
+// AuthorizationMode selects how the install controller synthesizes the
+// per-namespace persona ClusterRoles returned by generateNamespaceClusterRoles.
+type AuthorizationMode string
+
+const (
+	// AuthorizationModeAggregation builds persona ClusterRoles with an
+	// AggregationRule that collects rules from other, namespace-labeled
+	// ClusterRoles. This is the original, default behavior, and requires
+	// the RBAC aggregation controller to be running.
+	AuthorizationModeAggregation AuthorizationMode = "Aggregation"
+
+	// AuthorizationModeExplicit materializes the stack's permissions spec
+	// directly into each persona ClusterRole's Rules, rather than relying
+	// on aggregation. This works on clusters that don't run (or don't
+	// trust) the aggregation controller.
+	AuthorizationModeExplicit AuthorizationMode = "Explicit"
+
+	// AuthorizationModeWebhook delegates persona rule synthesis to an
+	// external, SubjectAccessReview-compatible webhook.
+	AuthorizationModeWebhook AuthorizationMode = "Webhook"
+)
+
+// defaultPersonas are the personas generated when AuthorizationOptions.Personas
+// is unset, matching the original hardcoded behavior.
+var defaultPersonas = []string{"admin", "edit", "view"}
+
+// PersonaRuleSynthesizer resolves the RBAC rules for a single persona in a
+// single namespace. It is the seam AuthorizationModeWebhook implements
+// against an external service.
+type PersonaRuleSynthesizer interface {
+	SynthesizeRules(ctx context.Context, namespace, persona string) ([]rbacv1.PolicyRule, error)
+}
+
+// explicitStackInstaller is a v1alpha1.StackInstaller whose package carries
+// the rules to materialize directly into a persona ClusterRole. It's
+// declared locally, and checked with a type assertion in rulesFor, the same
+// way verification.go's verifiedStackInstaller is — apis/stacks/v1alpha1
+// doesn't define this method on StackInstaller itself, so StackInstaller
+// implementations opt in by implementing it.
+type explicitStackInstaller interface {
+	v1alpha1.StackInstaller
+
+	// PersonaRules returns the RBAC rules to materialize into the named
+	// persona's ClusterRole.
+	PersonaRules(persona string) ([]rbacv1.PolicyRule, error)
+}
+
+// rulesFor returns i's explicit rules for persona, or an error if i doesn't
+// implement explicitStackInstaller.
+func rulesFor(i v1alpha1.StackInstaller, persona string) ([]rbacv1.PolicyRule, error) {
+	ei, ok := i.(explicitStackInstaller)
+	if !ok {
+		return nil, errors.Errorf("stack-authorization-mode is Explicit but stack installer %s does not support explicit persona rules", i.GetName())
+	}
+	return ei.PersonaRules(persona)
+}
+
+// AuthorizationOptions configures how namespace persona ClusterRoles are
+// generated for installed stacks.
+type AuthorizationOptions struct {
+	// Mode selects the synthesis strategy. Defaults to AuthorizationModeAggregation.
+	Mode AuthorizationMode
+
+	// Personas overrides the default admin/edit/view persona set.
+	Personas []string
+
+	// LabelTemplate overrides the default "namespace.crossplane.io/%s" label
+	// applied to namespace-scoped persona ClusterRoles.
+	LabelTemplate string
+
+	// Webhook synthesizes persona rules when Mode is AuthorizationModeWebhook.
+	// It is required in that mode and ignored otherwise.
+	Webhook PersonaRuleSynthesizer
+
+	modeFlag          string
+	personasFlag      []string
+	labelTemplateFlag string
+}
+
+// AddFlags binds flags for AuthorizationOptions to the given flag set.
+func (o *AuthorizationOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.modeFlag, "stack-authorization-mode", string(AuthorizationModeAggregation),
+		"the persona ClusterRole synthesis mode to use: Aggregation, Explicit, or Webhook")
+	fs.StringSliceVar(&o.personasFlag, "stack-authorization-personas", nil,
+		"a comma-separated list of personas to generate namespace ClusterRoles for, overriding the admin,edit,view default")
+	fs.StringVar(&o.labelTemplateFlag, "stack-authorization-label-template", "",
+		"a Sprintf template, taking the namespace name, overriding the default namespace.crossplane.io/%s persona ClusterRole label")
+}
+
+// ParseFlags must be called after the flag set passed to AddFlags has been
+// parsed, to validate and apply the selected mode.
+func (o *AuthorizationOptions) ParseFlags() error {
+	switch AuthorizationMode(o.modeFlag) {
+	case "", AuthorizationModeAggregation:
+		o.Mode = AuthorizationModeAggregation
+	case AuthorizationModeExplicit:
+		o.Mode = AuthorizationModeExplicit
+	case AuthorizationModeWebhook:
+		o.Mode = AuthorizationModeWebhook
+	default:
+		return errors.Errorf("unknown --stack-authorization-mode %q", o.modeFlag)
+	}
+	if len(o.personasFlag) > 0 {
+		o.Personas = o.personasFlag
+	}
+	if o.labelTemplateFlag != "" {
+		o.LabelTemplate = o.labelTemplateFlag
+	}
+	return nil
+}
+
+func (o *AuthorizationOptions) personas() []string {
+	if len(o.Personas) > 0 {
+		return o.Personas
+	}
+	return defaultPersonas
+}
+
+func (o *AuthorizationOptions) labelTemplate() string {
+	if o.LabelTemplate != "" {
+		return o.LabelTemplate
+	}
+	return labelNamespaceFmt
+}
+
+// generateNamespaceClusterRoles builds the namespace persona ClusterRoles for
+// i according to jc.authorization.Mode, replacing the previously hardcoded
+// aggregation-only implementation.
+func (jc *stackInstallJobCompleter) generateNamespaceClusterRoles(ctx context.Context, i v1alpha1.StackInstaller) ([]*rbacv1.ClusterRole, error) {
+	if i.PermissionScope() != string(apiextensions.NamespaceScoped) {
+		return nil, nil
+	}
+
+	ns := i.GetNamespace()
+	personas := jc.authorization.personas()
+	labelNamespace := fmt.Sprintf(jc.authorization.labelTemplate(), ns)
+	parentLabels := parentLabelsFor(i)
+
+	roles := make([]*rbacv1.ClusterRole, 0, len(personas))
+	for _, persona := range personas {
+		role := &rbacv1.ClusterRole{
+			TypeMeta:   rbacClusterRoleTypeMeta(),
+			ObjectMeta: rbacClusterRoleObjectMeta(ns, persona, labelNamespace, parentLabels),
+		}
+
+		switch jc.authorization.Mode {
+		case AuthorizationModeExplicit:
+			rules, err := rulesFor(i, persona)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to resolve explicit rules for persona %s", persona)
+			}
+			role.Rules = rules
+		case AuthorizationModeWebhook:
+			if jc.authorization.Webhook == nil {
+				return nil, errors.New("stack-authorization-mode is Webhook but no webhook synthesizer is configured")
+			}
+			rules, err := jc.authorization.Webhook.SynthesizeRules(ctx, ns, persona)
+			if err != nil {
+				return nil, errors.Wrapf(err, "webhook failed to synthesize rules for namespace %s persona %s", ns, persona)
+			}
+			role.Rules = rules
+		default:
+			role.AggregationRule = &rbacv1.AggregationRule{
+				ClusterRoleSelectors: aggregationSelectors(ns, persona),
+			}
+		}
+
+		roles = append(roles, role)
+	}
+
+	return roles, nil
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2019 The Crossplane Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/crossplaneio/crossplane-runtime/pkg/meta"
+	"github.com/crossplaneio/crossplane/apis/stacks/v1alpha1"
+)
+
+// installFinalizer is registered on every StackInstall and
+// ClusterStackInstall the install controller processes, so that deletion is
+// blocked until cascadeDelete has fully drained the cluster-scoped artifacts
+// that were created on its behalf.
+const installFinalizer = "finalizer.stacks.crossplane.io"
+
+// errDrainPending is returned by cascadeDelete when cleanup of one stage is
+// still in flight. Callers should requeue the deletion rather than treat it
+// as a terminal error.
+var errDrainPending = errors.New("waiting for stack installer artifacts to finish draining")
+
+// StackWithFinalize is implemented by StackInstaller kinds that need an
+// additional, kind-specific finalization step beyond the shared cascading
+// cleanup performed by cascadeDelete. This mirrors Kueue's JobWithFinalize:
+// most StackInstaller implementations don't need it, so it's an optional
+// interface checked with a type assertion rather than a required method on
+// StackInstaller itself.
+type StackWithFinalize interface {
+	v1alpha1.StackInstaller
+
+	// Finalize runs after cascadeDelete has finished removing every
+	// cluster-scoped artifact it knows how to find via labels. Kinds that
+	// create additional artifacts outside of that label set (for example
+	// ClusterStackInstall's cluster-wide namespace bindings) can clean them
+	// up here.
+	Finalize(ctx context.Context) error
+}
+
+// ensureFinalizer registers installFinalizer on i if it isn't already
+// present.
+func (jc *stackInstallJobCompleter) ensureFinalizer(ctx context.Context, i v1alpha1.StackInstaller) error {
+	if meta.FinalizerExists(i, installFinalizer) {
+		return nil
+	}
+	meta.AddFinalizer(i, installFinalizer)
+	if err := jc.client.Update(ctx, i); err != nil {
+		return errors.Wrapf(err, "failed to add finalizer to stack installer %s", i.GetName())
+	}
+	return nil
+}
+
+// cascadeDelete walks the labelParentUID (and friends) label set written by
+// createJobOutputObject and generateNamespaceClusterRoles to enumerate every
+// cluster-scoped artifact that belongs to i, and deletes them in dependency
+// order: custom resources first, then the CRDs that serve them, then the
+// aggregated namespace persona ClusterRoles, then any kind-specific cleanup.
+// It returns errDrainPending when a stage still has objects in flight, so
+// the caller can requeue instead of removing the finalizer prematurely.
+// Only once every stage reports empty does it remove installFinalizer from i.
+func (jc *stackInstallJobCompleter) cascadeDelete(ctx context.Context, i v1alpha1.StackInstaller) error {
+	if !meta.FinalizerExists(i, installFinalizer) {
+		return nil
+	}
+
+	sel := client.MatchingLabels(parentLabelsFor(i))
+
+	crds := &apiextensions.CustomResourceDefinitionList{}
+	if err := jc.client.List(ctx, crds, sel); err != nil {
+		return errors.Wrapf(err, "failed to list crds owned by stack installer %s", i.GetName())
+	}
+
+	// stage 1: delete any custom resources still served by the CRDs we're about to remove,
+	// so the API server doesn't orphan CRs when their CRD disappears out from under them
+	for j := range crds.Items {
+		drained, err := jc.deleteCustomResources(ctx, &crds.Items[j])
+		if err != nil {
+			return err
+		}
+		if !drained {
+			return errDrainPending
+		}
+	}
+
+	// stage 2: delete the CRDs themselves
+	for j := range crds.Items {
+		if err := jc.client.Delete(ctx, &crds.Items[j]); err != nil && !kerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete crd %s owned by stack installer %s", crds.Items[j].GetName(), i.GetName())
+		}
+	}
+	if len(crds.Items) > 0 {
+		return errDrainPending
+	}
+
+	// stage 3: delete the aggregated namespace persona clusterroles generated by
+	// generateNamespaceClusterRoles
+	roles := &rbacv1.ClusterRoleList{}
+	if err := jc.client.List(ctx, roles, sel); err != nil {
+		return errors.Wrapf(err, "failed to list clusterroles owned by stack installer %s", i.GetName())
+	}
+	for j := range roles.Items {
+		if err := jc.client.Delete(ctx, &roles.Items[j]); err != nil && !kerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete clusterrole %s owned by stack installer %s", roles.Items[j].GetName(), i.GetName())
+		}
+	}
+	if len(roles.Items) > 0 {
+		return errDrainPending
+	}
+
+	// stage 4: run any kind-specific cleanup, e.g. cluster-wide namespace label bindings
+	// that don't fit the generic label-based enumeration above
+	if wf, ok := i.(StackWithFinalize); ok {
+		if err := wf.Finalize(ctx); err != nil {
+			return errors.Wrapf(err, "failed to run kind-specific finalization for stack installer %s", i.GetName())
+		}
+	}
+
+	meta.RemoveFinalizer(i, installFinalizer)
+	if err := jc.client.Update(ctx, i); err != nil {
+		return errors.Wrapf(err, "failed to remove finalizer from stack installer %s", i.GetName())
+	}
+
+	return nil
+}
+
+// deleteCustomResources deletes every custom resource served by crd, in any
+// namespace, and reports whether none of them were left to delete so cascadeDelete
+// knows when it's safe to move on to deleting the CRD itself.
+func (jc *stackInstallJobCompleter) deleteCustomResources(ctx context.Context, crd *apiextensions.CustomResourceDefinition) (bool, error) {
+	for _, version := range crdServedVersions(crd) {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(schema.GroupVersionKind{
+			Group:   crd.Spec.Group,
+			Version: version,
+			Kind:    crd.Spec.Names.ListKind,
+		})
+
+		if err := jc.client.List(ctx, list); err != nil {
+			return false, errors.Wrapf(err, "failed to list custom resources for crd %s", crd.GetName())
+		}
+
+		if len(list.Items) == 0 {
+			continue
+		}
+
+		for j := range list.Items {
+			if err := jc.client.Delete(ctx, &list.Items[j]); err != nil && !kerrors.IsNotFound(err) {
+				return false, errors.Wrapf(err, "failed to delete custom resource %s/%s for crd %s", list.Items[j].GetNamespace(), list.Items[j].GetName(), crd.GetName())
+			}
+		}
+
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// crdServedVersions returns the set of versions a CRD currently serves,
+// supporting both the legacy singular spec.version field and the newer
+// spec.versions list.
+func crdServedVersions(crd *apiextensions.CustomResourceDefinition) []string {
+	if len(crd.Spec.Versions) == 0 {
+		return []string{crd.Spec.Version}
+	}
+	versions := make([]string, 0, len(crd.Spec.Versions))
+	for _, v := range crd.Spec.Versions {
+		if v.Served {
+			versions = append(versions, v.Name)
+		}
+	}
+	return versions
+}
@@ -58,22 +58,87 @@ var (
 	jobBackoff                = int32(0)
 	registryDirName           = ".registry"
 	packageContentsVolumeName = "package-contents"
-	labelNamespaceFmt         = "namespace.crossplane.io/%s"
+
+	unpackOutputFileName  = "unpack-output.yaml"
+	unpackOutputContainer = "unpack-output"
+
+	verifyContainerName   = "stack-verify"
+	verifyDigestFileName  = "resolved-digest.txt"
+	verifyDigestContainer = "verify-digest"
 )
 
 // JobCompleter is an interface for handling job completion
 type jobCompleter interface {
 	handleJobCompletion(ctx context.Context, i v1alpha1.StackInstaller, job *batchv1.Job) error
+
+	// handleDeletion is called on every reconcile of a StackInstaller that
+	// carries a deletion timestamp, so that cascadeDelete can drain the
+	// cluster-scoped artifacts created on its behalf before the API server
+	// is allowed to remove it.
+	handleDeletion(ctx context.Context, i v1alpha1.StackInstaller) error
 }
 
 // StackInstallJobCompleter is a concrete implementation of the jobCompleter interface
 type stackInstallJobCompleter struct {
-	client       client.Client
-	podLogReader Reader
+	client        client.Client
+	podLogReader  Reader
+	options       StackInstallOptions
+	authorization AuthorizationOptions
 }
 
 func createInstallJob(i v1alpha1.StackInstaller, executorInfo *stacks.ExecutorInfo) *batchv1.Job {
 	ref := meta.AsOwner(meta.ReferenceTo(i, i.GroupVersionKind()))
+	outputFile := filepath.Join("/ext-pkg", unpackOutputFileName)
+	digestFile := verifyDigestFilePath()
+
+	initContainers := []corev1.Container{}
+	// when the StackInstaller carries a verification policy, resolve and (optionally)
+	// verify the package image's digest before anything is copied out of it
+	if vc := buildVerifyInitContainer(i, executorInfo, digestFile); vc != nil {
+		initContainers = append(initContainers, *vc)
+	}
+	initContainers = append(initContainers, packageSourceInitContainers(asSourcedStackInstaller(i), executorInfo)...)
+	initContainers = append(initContainers,
+		corev1.Container{
+			Name:  "stack-executor",
+			Image: executorInfo.Image,
+			// "--debug" can be added to this list of Args to get verbose output from the
+			// executor. Because the unpacked manifests are now written to a file on the
+			// shared volume rather than captured from stdout, debug logging no longer risks
+			// corrupting the manifests we read back in handleJobCompletion.
+			Args: []string{
+				"stack",
+				"unpack",
+				fmt.Sprintf("--content-dir=%s", filepath.Join("/ext-pkg", registryDirName)),
+				fmt.Sprintf("--output-file=%s", outputFile),
+				"--permission-scope=" + i.PermissionScope(),
+			},
+			VolumeMounts: []corev1.VolumeMount{
+				{
+					Name:      packageContentsVolumeName,
+					MountPath: "/ext-pkg",
+				},
+			},
+		},
+	)
+
+	containers := []corev1.Container{
+		{
+			Name:    unpackOutputContainer,
+			Image:   executorInfo.Image,
+			Command: []string{"cat", outputFile},
+			VolumeMounts: []corev1.VolumeMount{
+				{
+					Name:      packageContentsVolumeName,
+					MountPath: "/ext-pkg",
+				},
+			},
+		},
+	}
+	if oc := buildVerifyOutputContainer(i, executorInfo, digestFile); oc != nil {
+		containers = append(containers, *oc)
+	}
+
 	return &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            i.GetName(),
@@ -85,40 +150,12 @@ func createInstallJob(i v1alpha1.StackInstaller, executorInfo *stacks.ExecutorIn
 			Template: corev1.PodTemplateSpec{
 				Spec: corev1.PodSpec{
 					RestartPolicy: corev1.RestartPolicyNever,
-					InitContainers: []corev1.Container{
-						{
-							Name:    "stack-package",
-							Image:   i.Image(),
-							Command: []string{"cp", "-R", registryDirName, "/ext-pkg/"},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      packageContentsVolumeName,
-									MountPath: "/ext-pkg",
-								},
-							},
-						},
-					},
-					Containers: []corev1.Container{
-						{
-							Name:  "stack-executor",
-							Image: executorInfo.Image,
-							// "--debug" can be added to this list of Args to get debug output from the job,
-							// but note that will be included in the stdout from the pod, which makes it
-							// impossible to create the resources that the job unpacks.
-							Args: []string{
-								"stack",
-								"unpack",
-								fmt.Sprintf("--content-dir=%s", filepath.Join("/ext-pkg", registryDirName)),
-								"--permission-scope=" + i.PermissionScope(),
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      packageContentsVolumeName,
-									MountPath: "/ext-pkg",
-								},
-							},
-						},
-					},
+					// The only non-init containers in the pod do nothing but stream files that
+					// earlier init containers wrote to the shared volume back out through their own
+					// stdout. Their logs are therefore guaranteed to be pure output bytes, regardless
+					// of anything the executor or verifier itself logs.
+					InitContainers: initContainers,
+					Containers:     containers,
 					Volumes: []corev1.Volume{
 						{
 							Name: packageContentsVolumeName,
@@ -136,14 +173,34 @@ func createInstallJob(i v1alpha1.StackInstaller, executorInfo *stacks.ExecutorIn
 func (jc *stackInstallJobCompleter) handleJobCompletion(ctx context.Context, i v1alpha1.StackInstaller, job *batchv1.Job) error {
 	var stackRecord *v1alpha1.Stack
 
+	// gate on the configured namespace/StackInstall selectors before doing any work.
+	// options.ToPredicate exists to pre-filter the corresponding informer watches so
+	// non-matching objects never reach the reconcile queue, but nothing in this package
+	// wires it into a watch, so this reconcile-time check is the only filtering that
+	// happens here.
+	if match, err := jc.matchesOptions(ctx, i); err != nil {
+		return err
+	} else if !match {
+		log.V(logging.Debug).Info("skipping job completion, stack installer does not match configured selectors", "name", i.GetName(), "namespace", i.GetNamespace())
+		return nil
+	}
+
+	// register installFinalizer before we create any cluster-scoped artifacts on i's
+	// behalf, so that cascadeDelete is guaranteed to run and drain them on deletion
+	if err := jc.ensureFinalizer(ctx, i); err != nil {
+		return err
+	}
+
 	// find the pod associated with the given job
 	podName, err := jc.findPodNameForJob(ctx, job)
 	if err != nil {
 		return err
 	}
 
-	// read full output from job by retrieving the logs for the job's pod
-	b, err := jc.readPodLogs(job.Namespace, podName)
+	// read the unpacked manifests back by retrieving the logs of the pod's unpack-output
+	// container, which does nothing but stream the contents of the shared volume that the
+	// stack-executor init container wrote its output to
+	b, err := jc.readPodLogs(job.Namespace, podName, unpackOutputContainer)
 	if err != nil {
 		return err
 	}
@@ -179,6 +236,20 @@ func (jc *stackInstallJobCompleter) handleJobCompletion(ctx context.Context, i v
 		return errors.Errorf("failed to find a stack record from job %s", job.Name)
 	}
 
+	// if a verification policy was configured, pull the digest that the stack-verify init
+	// container resolved and pin the stack record to it so that future reconciles don't
+	// silently pick up a different image behind the same tag
+	if verificationFor(i) != nil && hasImagePackageSource(i) {
+		digest, err := jc.readPodLogs(job.Namespace, podName, verifyDigestContainer)
+		if err != nil {
+			return err
+		}
+		stackRecord.Status.ResolvedImageDigest = strings.TrimSpace(digest.String())
+		if err := jc.client.Status().Update(ctx, stackRecord); err != nil {
+			return errors.Wrapf(err, "failed to pin resolved digest onto stack record %s/%s from job %s", stackRecord.GetNamespace(), stackRecord.GetName(), job.Name)
+		}
+	}
+
 	// save a reference to the stack record in the status of the stack install
 	i.SetStackRecord(&corev1.ObjectReference{
 		APIVersion: stackRecord.APIVersion,
@@ -191,6 +262,35 @@ func (jc *stackInstallJobCompleter) handleJobCompletion(ctx context.Context, i v
 	return nil
 }
 
+// handleDeletion drains i's cluster-scoped artifacts via cascadeDelete, returning
+// errDrainPending for the caller to requeue rather than treat as a terminal error.
+func (jc *stackInstallJobCompleter) handleDeletion(ctx context.Context, i v1alpha1.StackInstaller) error {
+	return jc.cascadeDelete(ctx, i)
+}
+
+// matchesOptions reports whether the given StackInstaller satisfies the configured
+// StackInstallOptions: its own labels must match options.StackInstallSelector, and its
+// namespace's labels must match options.NamespaceSelector. Cluster-scoped installers
+// (ClusterStackInstall) have no namespace of their own, so options.NamespaceSelector
+// doesn't apply to them, the same way generateNamespaceClusterRoles treats cluster
+// scope as exempt from namespace-scoped behavior.
+func (jc *stackInstallJobCompleter) matchesOptions(ctx context.Context, i v1alpha1.StackInstaller) (bool, error) {
+	if ok, err := jc.options.MatchesStackInstallLabels(i.GetLabels()); err != nil || !ok {
+		return ok, err
+	}
+
+	if jc.options.NamespaceSelector == nil || i.PermissionScope() != string(apiextensions.NamespaceScoped) {
+		return true, nil
+	}
+
+	ns := &corev1.Namespace{}
+	if err := jc.client.Get(ctx, types.NamespacedName{Name: i.GetNamespace()}, ns); err != nil {
+		return false, errors.Wrapf(err, "failed to get namespace %s for stack installer %s", i.GetNamespace(), i.GetName())
+	}
+
+	return jc.options.MatchesNamespaceLabels(ns.GetLabels())
+}
+
 // findPodNameForJob finds the pod name associated with the given job.  Note that this functions
 // assumes only a single pod will be associated with the job.
 func (jc *stackInstallJobCompleter) findPodNameForJob(ctx context.Context, job *batchv1.Job) (string, error) {
@@ -219,71 +319,85 @@ func (jc *stackInstallJobCompleter) findPodsForJob(ctx context.Context, job *bat
 	return podList, nil
 }
 
-func (jc *stackInstallJobCompleter) readPodLogs(namespace, name string) (*bytes.Buffer, error) {
-	podLogs, err := jc.podLogReader.GetReader(namespace, name)
+func (jc *stackInstallJobCompleter) readPodLogs(namespace, name, container string) (*bytes.Buffer, error) {
+	podLogs, err := jc.podLogReader.GetReader(namespace, name, container)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to get logs request stream from pod %s", name)
+		return nil, errors.Wrapf(err, "failed to get logs request stream from pod %s container %s", name, container)
 	}
 	defer func() { _ = podLogs.Close() }()
 
 	b := new(bytes.Buffer)
 	if _, err = io.Copy(b, podLogs); err != nil {
-		return nil, errors.Wrapf(err, "failed to copy logs request stream from pod %s", name)
+		return nil, errors.Wrapf(err, "failed to copy logs request stream from pod %s container %s", name, container)
 	}
 
 	return b, nil
 }
 
-func generateNamespaceClusterRoles(i v1alpha1.StackInstaller) (roles []*rbacv1.ClusterRole) {
-	personas := []string{"admin", "edit", "view"}
+// rbacClusterRoleTypeMeta returns the TypeMeta shared by every generated
+// namespace persona ClusterRole.
+func rbacClusterRoleTypeMeta() metav1.TypeMeta {
+	return metav1.TypeMeta{
+		Kind:       "ClusterRole",
+		APIVersion: "rbac.authorization.k8s.io/v1",
+	}
+}
 
-	namespaced := (i.PermissionScope() == string(apiextensions.NamespaceScoped))
-	if !namespaced {
-		return
+// rbacClusterRoleObjectMeta returns the ObjectMeta shared by every generated
+// namespace persona ClusterRole, regardless of authorization mode. parentLabels
+// are stamped on so that the finalizer's cascading cleanup can find every
+// artifact that belongs to a given StackInstaller the same way it finds CRDs.
+func rbacClusterRoleObjectMeta(ns, persona, labelNamespace string, parentLabels map[string]string) metav1.ObjectMeta {
+	labels := map[string]string{labelNamespace: "true"}
+	for k, v := range parentLabels {
+		labels[k] = v
+	}
+	return metav1.ObjectMeta{
+		Name:   fmt.Sprintf("crossplane:ns:%s:%s", ns, persona),
+		Labels: labels,
 	}
+}
 
-	ns := i.GetNamespace()
-	for _, persona := range personas {
-		name := fmt.Sprintf("crossplane:ns:%s:%s", ns, persona)
-		role := &rbacv1.ClusterRole{
-			TypeMeta: metav1.TypeMeta{
-				Kind:       "ClusterRole",
-				APIVersion: "rbac.authorization.k8s.io/v1",
-			},
-			AggregationRule: &rbacv1.AggregationRule{
-				ClusterRoleSelectors: []metav1.LabelSelector{
-					{
-						MatchLabels: map[string]string{
-							fmt.Sprintf("rbac.crossplane.io/aggregate-to-namespace-%s", persona): "true",
-							fmt.Sprintf("namespace.crossplane.io/%s", ns):                        "true",
-						},
-					},
-					{
-						MatchLabels: map[string]string{
-							fmt.Sprintf("rbac.crossplane.io/aggregate-to-namespace-default-%s", persona): "true",
-						},
-					},
-				},
+// parentLabelsFor returns the labelParent* label set used to tie a
+// cluster-scoped artifact (CRD, persona ClusterRole, etc.) back to the
+// StackInstaller that produced it, since a namespaced StackInstall can't own
+// a cluster-scoped object via an OwnerReference.
+func parentLabelsFor(i v1alpha1.StackInstaller) map[string]string {
+	gvk := i.GroupVersionKind()
+	return map[string]string{
+		labelParentGroup:     gvk.Group,
+		labelParentVersion:   gvk.Version,
+		labelParentKind:      gvk.Kind,
+		labelParentNamespace: i.GetNamespace(),
+		labelParentName:      i.GetName(),
+		labelParentUID:       string(i.GetUID()),
+	}
+}
+
+// aggregationSelectors returns the ClusterRoleSelectors used by
+// AuthorizationModeAggregation, unchanged from the original hardcoded
+// behavior.
+func aggregationSelectors(ns, persona string) []metav1.LabelSelector {
+	return []metav1.LabelSelector{
+		{
+			MatchLabels: map[string]string{
+				fmt.Sprintf("rbac.crossplane.io/aggregate-to-namespace-%s", persona): "true",
+				fmt.Sprintf("namespace.crossplane.io/%s", ns):                        "true",
 			},
-			// TODO(displague) set parent labels?
-			ObjectMeta: metav1.ObjectMeta{
-				Name:   name,
-				Labels: map[string]string{},
+		},
+		{
+			MatchLabels: map[string]string{
+				fmt.Sprintf("rbac.crossplane.io/aggregate-to-namespace-default-%s", persona): "true",
 			},
-		}
-		if namespaced {
-			labelNamespace := fmt.Sprintf(labelNamespaceFmt, ns)
-
-			role.ObjectMeta.Labels[labelNamespace] = "true"
-		}
-		roles = append(roles, role)
+		},
 	}
-
-	return roles
 }
 
 func (jc *stackInstallJobCompleter) createNamespaceClusterRoles(ctx context.Context, i v1alpha1.StackInstaller) error {
-	roles := generateNamespaceClusterRoles(i)
+	roles, err := jc.generateNamespaceClusterRoles(ctx, i)
+	if err != nil {
+		return errors.Wrapf(err, "failed to generate namespace persona clusterroles for stackinstall %s", i.GetName())
+	}
 
 	for _, role := range roles {
 		if err := jc.client.Create(ctx, role); err != nil && !kerrors.IsAlreadyExists(err) {
@@ -295,7 +409,9 @@ func (jc *stackInstallJobCompleter) createNamespaceClusterRoles(ctx context.Cont
 
 // createJobOutputObject names, labels, sets ownership, and creates resources
 // resulting from a StackInstall or ClusterStackInstall. These expected
-// resources are currently CRD and Stack objects
+// resources are currently CRD and Stack objects. Callers must have already
+// confirmed i matches jc.options via matchesOptions; this is only ever
+// called from handleJobCompletion, which does so.
 func (jc *stackInstallJobCompleter) createJobOutputObject(ctx context.Context, obj *unstructured.Unstructured,
 	i v1alpha1.StackInstaller, job *batchv1.Job) error {
 
@@ -323,16 +439,8 @@ func (jc *stackInstallJobCompleter) createJobOutputObject(ctx context.Context, o
 	// We want to clean up any installed CRDS when we're deleted. We can't rely
 	// on garbage collection because a namespaced object (StackInstall) can't
 	// own a cluster scoped object (CustomResourceDefinition), so we use labels
-	// instead.
-	gvk := i.GroupVersionKind()
-	labels := map[string]string{
-		labelParentGroup:     gvk.Group,
-		labelParentVersion:   gvk.Version,
-		labelParentKind:      gvk.Kind,
-		labelParentNamespace: i.GetNamespace(),
-		labelParentName:      i.GetName(),
-		labelParentUID:       string(i.GetUID()),
-	}
+	// instead, walked by the finalizer's cascading cleanup.
+	labels := parentLabelsFor(i)
 
 	if isCRDObject(obj) {
 		labelNamespaceFmt := "namespace.crossplane.io/%s"
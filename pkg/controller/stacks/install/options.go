@@ -0,0 +1,124 @@
+/*
+Copyright 2019 The Crossplane Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// StackInstallOptions gates which StackInstall and ClusterStackInstall
+// objects this controller-manager's install controller will act on. A nil
+// selector matches everything, preserving today's behavior of managing
+// every StackInstall in the cluster.
+type StackInstallOptions struct {
+	// NamespaceSelector restricts reconciliation to namespace-scoped
+	// StackInstalls whose namespace matches the given label selector. It is
+	// not applied to ClusterStackInstalls.
+	NamespaceSelector *metav1.LabelSelector
+
+	// StackInstallSelector restricts reconciliation to StackInstall and
+	// ClusterStackInstall objects whose own labels match the given
+	// selector.
+	StackInstallSelector *metav1.LabelSelector
+
+	namespaceSelectorFlag    string
+	stackInstallSelectorFlag string
+}
+
+// AddFlags binds flags for StackInstallOptions to the given flag set, in the
+// same style as the rest of the controller-manager's component flags.
+func (o *StackInstallOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.namespaceSelectorFlag, "stack-install-namespace-selector", "",
+		"a label selector that restricts which namespaces' StackInstalls this controller-manager will reconcile")
+	fs.StringVar(&o.stackInstallSelectorFlag, "stack-install-selector", "",
+		"a label selector that restricts which StackInstall and ClusterStackInstall objects this controller-manager will reconcile")
+}
+
+// ParseFlags must be called after the flag set passed to AddFlags has been
+// parsed, to convert the raw selector strings into the LabelSelectors used
+// by the rest of the package.
+func (o *StackInstallOptions) ParseFlags() error {
+	if o.namespaceSelectorFlag != "" {
+		sel, err := metav1.ParseToLabelSelector(o.namespaceSelectorFlag)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse --stack-install-namespace-selector")
+		}
+		o.NamespaceSelector = sel
+	}
+	if o.stackInstallSelectorFlag != "" {
+		sel, err := metav1.ParseToLabelSelector(o.stackInstallSelectorFlag)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse --stack-install-selector")
+		}
+		o.StackInstallSelector = sel
+	}
+	return nil
+}
+
+// MatchesStackInstallLabels reports whether the given StackInstall (or
+// ClusterStackInstall) labels satisfy o.StackInstallSelector. A nil selector
+// matches everything.
+func (o *StackInstallOptions) MatchesStackInstallLabels(l map[string]string) (bool, error) {
+	return matchesSelector(o.StackInstallSelector, l)
+}
+
+// MatchesNamespaceLabels reports whether the given namespace's labels
+// satisfy o.NamespaceSelector. A nil selector matches everything.
+func (o *StackInstallOptions) MatchesNamespaceLabels(l map[string]string) (bool, error) {
+	return matchesSelector(o.NamespaceSelector, l)
+}
+
+func matchesSelector(ls *metav1.LabelSelector, l map[string]string) (bool, error) {
+	if ls == nil {
+		return true, nil
+	}
+	sel, err := metav1.LabelSelectorAsSelector(ls)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to convert label selector")
+	}
+	return sel.Matches(labels.Set(l)), nil
+}
+
+// ToPredicate returns a controller-runtime predicate that pre-filters
+// informer events for StackInstall and ClusterStackInstall objects using
+// o.StackInstallSelector, so that non-matching objects never reach the
+// reconcile queue in the first place once registered with a watch. Nothing
+// in this package registers it with a watch; handleJobCompletion filters at
+// reconcile time through matchesOptions, which checks both selectors.
+func (o *StackInstallOptions) ToPredicate() (predicate.Predicate, error) {
+	if o.StackInstallSelector == nil {
+		return predicate.Funcs{}, nil
+	}
+	sel, err := metav1.LabelSelectorAsSelector(o.StackInstallSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert stack install label selector")
+	}
+	matches := func(meta metav1.Object) bool {
+		return sel.Matches(labels.Set(meta.GetLabels()))
+	}
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return matches(e.Meta) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return matches(e.MetaNew) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return matches(e.Meta) },
+		GenericFunc: func(e event.GenericEvent) bool { return matches(e.Meta) },
+	}, nil
+}
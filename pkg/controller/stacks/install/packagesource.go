@@ -0,0 +1,212 @@
+/*
+Copyright 2019 The Crossplane Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/crossplaneio/crossplane/apis/stacks/v1alpha1"
+	"github.com/crossplaneio/crossplane/pkg/stacks"
+)
+
+// sourcedStackInstaller is a v1alpha1.StackInstaller whose package source
+// has been generalized beyond a single container image. It's declared
+// locally, and checked with a type assertion in asSourcedStackInstaller, the
+// same way verification.go's verifiedStackInstaller is — apis/stacks/v1alpha1
+// doesn't define this method on StackInstaller itself, so StackInstaller
+// implementations opt in by implementing it.
+type sourcedStackInstaller interface {
+	v1alpha1.StackInstaller
+
+	// Source returns the configured package source, or nil to fall back to
+	// treating Image() as a plain container image.
+	Source() PackageSource
+}
+
+// PackageSource builds the init container chain that populates the
+// package-contents volume with a stack package's unpacked ".registry"
+// directory, regardless of where the package actually comes from. Every
+// implementation is expected to leave a valid registryDirName directory at
+// "/ext-pkg", so that the stack-executor init container's "stack unpack
+// --content-dir=..." invocation stays identical across source kinds.
+type PackageSource interface {
+	// InitContainers returns the init containers, in order, that populate
+	// "/ext-pkg" with the package's registry directory.
+	InitContainers(executorInfo *stacks.ExecutorInfo) []corev1.Container
+}
+
+// ImagePackageSource is the original PackageSource: the package is a
+// container image whose ".registry" directory is copied out of it. This is
+// used whenever a StackInstaller's Source() returns nil, preserving the
+// pre-existing behavior for image-based packages.
+type ImagePackageSource struct {
+	// Image is the package image reference to copy the registry directory
+	// out of.
+	Image string
+}
+
+// InitContainers implements PackageSource.
+func (s *ImagePackageSource) InitContainers(executorInfo *stacks.ExecutorInfo) []corev1.Container {
+	return []corev1.Container{
+		{
+			Name:    "stack-package",
+			Image:   s.Image,
+			Command: []string{"cp", "-R", registryDirName, "/ext-pkg/"},
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: packageContentsVolumeName, MountPath: "/ext-pkg"},
+			},
+		},
+	}
+}
+
+// OCIArtifactPackageSource packages the registry directory as the layers of
+// an OCI artifact (no runnable image), pulled with ORAS.
+//
+// InitContainers reads executorInfo.ORASImage, which this series assumes
+// stacks.ExecutorInfo gains alongside HelmImage below; pkg/stacks isn't
+// touched here, so until it grows both fields this won't build against the
+// real type.
+type OCIArtifactPackageSource struct {
+	// Reference is the OCI artifact reference to pull, e.g.
+	// "registry.example.com/stacks/my-stack:1.0.0".
+	Reference string
+}
+
+// InitContainers implements PackageSource.
+func (s *OCIArtifactPackageSource) InitContainers(executorInfo *stacks.ExecutorInfo) []corev1.Container {
+	return []corev1.Container{
+		{
+			Name:  "stack-package-oras",
+			Image: executorInfo.ORASImage,
+			Args:  []string{"pull", s.Reference, "--output", "/ext-pkg"},
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: packageContentsVolumeName, MountPath: "/ext-pkg"},
+			},
+		},
+	}
+}
+
+// HelmChartPackageSource renders a Helm chart's CRDs and Stack manifest into
+// the registry directory convention via an in-cluster templating init
+// container, rather than assuming the package is a container image.
+//
+// InitContainers reads executorInfo.HelmImage, the same not-yet-real
+// stacks.ExecutorInfo field called out on OCIArtifactPackageSource above.
+type HelmChartPackageSource struct {
+	// Repo is the Helm chart repository URL.
+	Repo string
+	// Chart is the chart name within Repo.
+	Chart string
+	// Version is the chart version to render.
+	Version string
+}
+
+// InitContainers implements PackageSource.
+func (s *HelmChartPackageSource) InitContainers(executorInfo *stacks.ExecutorInfo) []corev1.Container {
+	registryDir := fmt.Sprintf("/ext-pkg/%s", registryDirName)
+	return []corev1.Container{
+		{
+			Name:  "stack-package-helm-template",
+			Image: executorInfo.HelmImage,
+			Args: []string{
+				"template", s.Chart,
+				"--repo", s.Repo,
+				"--version", s.Version,
+				"--output-dir", registryDir,
+			},
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: packageContentsVolumeName, MountPath: "/ext-pkg"},
+			},
+		},
+	}
+}
+
+// HTTPTarballPackageSource fetches a plain HTTPS tarball of the registry
+// directory, verifying it against a supplied checksum before unpacking it.
+type HTTPTarballPackageSource struct {
+	// URL is the HTTPS location of the tarball.
+	URL string
+	// SHA256 is the expected hex-encoded SHA-256 checksum of the tarball.
+	SHA256 string
+}
+
+// InitContainers implements PackageSource.
+func (s *HTTPTarballPackageSource) InitContainers(executorInfo *stacks.ExecutorInfo) []corev1.Container {
+	script := fmt.Sprintf(
+		"set -euo pipefail; curl -fsSL %s -o /tmp/package.tar.gz; echo '%s  /tmp/package.tar.gz' | sha256sum -c -; tar -xzf /tmp/package.tar.gz -C /ext-pkg",
+		s.URL, s.SHA256,
+	)
+	return []corev1.Container{
+		{
+			Name:    "stack-package-tarball",
+			Image:   executorInfo.Image,
+			Command: []string{"sh", "-c", script},
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: packageContentsVolumeName, MountPath: "/ext-pkg"},
+			},
+		},
+	}
+}
+
+// packageSourceInitContainers returns the init containers that populate the
+// package-contents volume for i, dispatching on i.Source(). A nil Source
+// falls back to ImagePackageSource, preserving the original "package is a
+// container image" behavior.
+func packageSourceInitContainers(i sourcedStackInstaller, executorInfo *stacks.ExecutorInfo) []corev1.Container {
+	src := i.Source()
+	if src == nil {
+		src = &ImagePackageSource{Image: i.Image()}
+	}
+	return src.InitContainers(executorInfo)
+}
+
+// asSourcedStackInstaller adapts a plain v1alpha1.StackInstaller to a
+// sourcedStackInstaller, falling back to the original image-only behavior
+// for StackInstaller implementations that don't yet support Source().
+func asSourcedStackInstaller(i v1alpha1.StackInstaller) sourcedStackInstaller {
+	if si, ok := i.(sourcedStackInstaller); ok {
+		return si
+	}
+	return imageOnlyStackInstaller{i}
+}
+
+// hasImagePackageSource reports whether i's resolved package source is a
+// container image: either it doesn't implement sourcedStackInstaller, or it
+// does but Source() returns nil or an *ImagePackageSource. buildVerifyInitContainer
+// and buildVerifyOutputContainer use this to skip image digest verification
+// for sources, such as Helm charts and HTTPS tarballs, that have no image to
+// verify.
+func hasImagePackageSource(i v1alpha1.StackInstaller) bool {
+	switch asSourcedStackInstaller(i).Source().(type) {
+	case nil, *ImagePackageSource:
+		return true
+	default:
+		return false
+	}
+}
+
+// imageOnlyStackInstaller adapts a v1alpha1.StackInstaller to
+// sourcedStackInstaller by always reporting a nil Source, so that
+// packageSourceInitContainers falls back to ImagePackageSource.
+type imageOnlyStackInstaller struct {
+	v1alpha1.StackInstaller
+}
+
+// Source implements sourcedStackInstaller.
+func (imageOnlyStackInstaller) Source() PackageSource { return nil }
@@ -0,0 +1,145 @@
+/*
+Copyright 2019 The Crossplane Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"fmt"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/crossplaneio/crossplane/apis/stacks/v1alpha1"
+	"github.com/crossplaneio/crossplane/pkg/stacks"
+)
+
+// PackageVerification describes the supply-chain verification policy
+// configured on a StackInstaller's package: the digest and/or public key to
+// check spec.package against before unpack. It mirrors the shape
+// spec.package.verification would take on the real StackInstall/
+// ClusterStackInstall types, but until those types grow that field and a
+// concrete Verification method, nothing in apis/stacks/v1alpha1 can satisfy
+// verifiedStackInstaller, so buildVerifyInitContainer/buildVerifyOutputContainer
+// never activate for a real resource yet.
+type PackageVerification struct {
+	Digest             string
+	PublicKeyRef       *corev1.LocalObjectReference
+	InsecureSkipVerify bool
+}
+
+// verifiedStackInstaller is a v1alpha1.StackInstaller whose package carries a
+// PackageVerification. It's declared locally, and checked with a type
+// assertion in verificationFor, because apis/stacks/v1alpha1 doesn't define
+// this method on StackInstaller itself, so StackInstaller implementations
+// opt in by implementing it.
+type verifiedStackInstaller interface {
+	v1alpha1.StackInstaller
+
+	// Verification returns the configured verification policy, or nil if
+	// none is configured.
+	Verification() *PackageVerification
+}
+
+// verificationFor returns i's configured PackageVerification, or nil if i
+// doesn't implement verifiedStackInstaller or hasn't configured one.
+func verificationFor(i v1alpha1.StackInstaller) *PackageVerification {
+	vi, ok := i.(verifiedStackInstaller)
+	if !ok {
+		return nil
+	}
+	return vi.Verification()
+}
+
+// buildVerifyInitContainer returns the init container that resolves
+// i.Image() to an immutable digest and, when a verification is configured
+// on the StackInstaller, checks it against the digest and/or public key
+// recorded on spec.package.verification before any package contents are
+// copied out of the image. It returns nil when no verification is
+// configured, or when i's package source isn't a container image in the
+// first place, in which case createInstallJob skips verification entirely.
+func buildVerifyInitContainer(i v1alpha1.StackInstaller, executorInfo *stacks.ExecutorInfo, digestFile string) *corev1.Container {
+	v := verificationFor(i)
+	if v == nil || !hasImagePackageSource(i) {
+		return nil
+	}
+
+	args := []string{
+		"stack",
+		"verify",
+		"--image=" + i.Image(),
+		fmt.Sprintf("--resolved-digest-file=%s", digestFile),
+	}
+	if v.Digest != "" {
+		args = append(args, "--digest="+v.Digest)
+	}
+	if v.InsecureSkipVerify {
+		args = append(args, "--insecure-skip-verify")
+	}
+
+	c := &corev1.Container{
+		Name:  verifyContainerName,
+		Image: executorInfo.Image,
+		Args:  args,
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      packageContentsVolumeName,
+				MountPath: "/ext-pkg",
+			},
+		},
+	}
+
+	if v.PublicKeyRef != nil {
+		args = append(args, "--public-key-secret="+v.PublicKeyRef.Name)
+		c.Args = args
+		c.EnvFrom = []corev1.EnvFromSource{
+			{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: v.PublicKeyRef.Name},
+				},
+			},
+		}
+	}
+
+	return c
+}
+
+// buildVerifyOutputContainer returns the container that streams the digest
+// resolved by the stack-verify init container back out through its own
+// stdout, mirroring the unpack-output container added for the manifests
+// themselves. It returns nil when no verification is configured, or when
+// i's package source isn't a container image, mirroring
+// buildVerifyInitContainer.
+func buildVerifyOutputContainer(i v1alpha1.StackInstaller, executorInfo *stacks.ExecutorInfo, digestFile string) *corev1.Container {
+	if verificationFor(i) == nil || !hasImagePackageSource(i) {
+		return nil
+	}
+
+	return &corev1.Container{
+		Name:    verifyDigestContainer,
+		Image:   executorInfo.Image,
+		Command: []string{"cat", digestFile},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      packageContentsVolumeName,
+				MountPath: "/ext-pkg",
+			},
+		},
+	}
+}
+
+func verifyDigestFilePath() string {
+	return filepath.Join("/ext-pkg", verifyDigestFileName)
+}